@@ -14,10 +14,49 @@
 package tsdb
 
 import (
+	"context"
 	"math"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// maxIsolationShards caps the number of append shards. State/SnapshotState
+// have to RLock every shard in turn, so shard count isn't free on the read
+// side; this keeps that fan-out bounded even on very high-core machines.
+const maxIsolationShards = 32
+
+// defaultNumIsolationShards sizes the shard count off GOMAXPROCS rather
+// than a flat constant, so single-core/low-core deployments don't pay the
+// per-shard RLock cost on every State call for append-side parallelism
+// they don't have.
+func defaultNumIsolationShards() int {
+	if n := runtime.GOMAXPROCS(0); n < maxIsolationShards {
+		return n
+	}
+	return maxIsolationShards
+}
+
+// IsolationObserver receives append/read contention events from the
+// isolation subsystem. Implementations must be safe for concurrent use.
+type IsolationObserver interface {
+	// OnAppendOpened is called when a new appendID has been handed out.
+	OnAppendOpened(appendID uint64, minTime int64)
+	// OnAppendClosed is called when an append is closed (committed or
+	// rolled back), durationNs after it was opened.
+	OnAppendClosed(appendID uint64, durationNs int64)
+	// OnReadOpened is called when a read transaction starts tracking
+	// isolation, with the number of appends it considers incomplete.
+	OnReadOpened(mint, maxt int64, incompleteAppends int)
+	// OnReadClosed is called when a read transaction's isolation state is
+	// closed, durationNs after it was opened.
+	OnReadClosed(durationNs int64)
+	// OnShardLockWait is called after newAppendID acquires a shard's
+	// appendMtx, with how long that acquisition took.
+	OnShardLockWait(durationNs int64)
+}
+
 // isolationState holds the isolation information.
 type isolationState struct {
 	// We will ignore all appends above the max, or that are incomplete.
@@ -27,13 +66,29 @@ type isolationState struct {
 	isolation         *isolation
 	mint, maxt        int64 // Time ranges of the read.
 
-	// Doubly linked list of active reads.
+	// snapshot is true for a state returned by SnapshotState: it is never
+	// linked into readsOpen, so Close only reports OnReadClosed to the
+	// observer (if any) and head truncation never waits on it. See SnapshotState for the consistency trade-off this
+	// implies.
+	snapshot bool
+
+	// openedAt is set when isolation.observer is non-nil, so Close can
+	// report how long the read was open.
+	openedAt time.Time
+
+	// Doubly linked list of active reads. Unused when snapshot is true.
 	next *isolationState
 	prev *isolationState
 }
 
 // Close closes the state.
 func (i *isolationState) Close() {
+	if obs := i.isolation.observer; obs != nil {
+		obs.OnReadClosed(time.Since(i.openedAt).Nanoseconds())
+	}
+	if i.snapshot {
+		return
+	}
 	i.isolation.readMtx.Lock()
 	defer i.isolation.readMtx.Unlock()
 	i.next.prev = i.prev
@@ -49,46 +104,250 @@ type isolationAppender struct {
 	minTime  int64
 	prev     *isolationAppender
 	next     *isolationAppender
+
+	// openedAt records when the append was opened, used both to report
+	// OnAppendClosed durations and to let the reaper find appenders that
+	// have overstayed MaxAppenderAge.
+	openedAt time.Time
 }
 
-// isolation is the global isolation state.
-type isolation struct {
-	// Mutex for accessing lastAppendID and appendsOpen.
+// isolationShard holds one independent slice of the append-tracking state.
+// Appends are routed to a shard by appendID, so that concurrent appenders
+// hitting different shards never contend on the same appendMtx.
+type isolationShard struct {
+	// Mutex for accessing appendsOpen and appendsOpenList in this shard.
 	appendMtx sync.RWMutex
-	// Which appends are currently in progress.
+	// Which appends in this shard are currently in progress.
 	appendsOpen map[uint64]*isolationAppender
-	// New appenders with higher appendID are added to the end. First element keeps lastAppendId.
-	// appendsOpenList.next points to the first element and appendsOpenList.prev points to the last element.
-	// If there are no appenders, both point back to appendsOpenList.
+	// New appenders for this shard are added to the end. appendsOpenList.next
+	// points to the first element and appendsOpenList.prev to the last.
+	// If there are no appenders in the shard, both point back to appendsOpenList.
 	appendsOpenList *isolationAppender
 	// Pool of reusable *isolationAppender to save on allocations.
 	appendersPool sync.Pool
+}
+
+func newIsolationShard() *isolationShard {
+	appender := &isolationAppender{}
+	appender.next = appender
+	appender.prev = appender
+
+	return &isolationShard{
+		appendsOpen:     map[uint64]*isolationAppender{},
+		appendsOpenList: appender,
+		appendersPool:   sync.Pool{New: func() interface{} { return &isolationAppender{} }},
+	}
+}
+
+// isolation is the global isolation state.
+type isolation struct {
+	// lastAppendID is the last appendID handed out. Bumped atomically so
+	// that newAppendID never has to take a global lock to mint an ID.
+	lastAppendID uint64
+	// shards partitions the in-flight appenders by appendID % len(shards),
+	// so that append fan-out doesn't serialize on a single mutex.
+	shards []*isolationShard
 
 	// Mutex for accessing readsOpen.
-	// If taking both appendMtx and readMtx, take appendMtx first.
+	// If taking both a shard's appendMtx and readMtx, take the shard's
+	// appendMtx first; when taking more than one shard's appendMtx (as
+	// State does), take them in ascending shard-index order, and always
+	// before readMtx, to avoid deadlocks.
 	readMtx sync.RWMutex
 	// All current in use isolationStates. This is a doubly-linked list.
 	readsOpen *isolationState
 	// If true, writes are not tracked while reads are still tracked.
 	disabled bool
+
+	// observer is notified of append/read open and close events. May be
+	// nil, in which case no observer work is done.
+	observer IsolationObserver
+
+	// admission is a counting semaphore bounding the number of concurrently
+	// open appenders; nil means unbounded (MaxOpenAppenders <= 0).
+	admission chan struct{}
+	// maxAppenderAge is the deadline after which the reaper force-closes an
+	// open appender; <= 0 disables the reaper.
+	maxAppenderAge time.Duration
+	// onForceRollback is invoked by the reaper just before it force-closes
+	// an appender that exceeded maxAppenderAge, so Head can mark that
+	// appender's samples as rolled back and free its txRing entries. May
+	// be nil.
+	onForceRollback func(appendID uint64)
+
+	reaperStop chan struct{}
+	reaperDone chan struct{}
+	stopReaper sync.Once
+}
+
+// IsolationOptions bounds how many appenders may be open at once and how
+// long any single one may stay open, so that a stuck appender (e.g. a
+// remote-write batch that never calls Commit/Rollback) can't pin the low
+// watermark and grow incompleteAppends without bound. Zero values disable
+// the corresponding control.
+type IsolationOptions struct {
+	MaxOpenAppenders int
+	MaxAppenderAge   time.Duration
+	// OnForceRollback is invoked by the reaper just before it force-closes
+	// an appender that exceeded MaxAppenderAge. May be nil.
+	OnForceRollback func(appendID uint64)
+}
+
+// newIsolation creates a new isolation struct. observer may be nil, in
+// which case isolation events are not reported anywhere (existing callers
+// that don't care about observability pay nothing for it).
+func newIsolation(disabled bool, observer IsolationObserver, opts IsolationOptions) *isolation {
+	return newIsolationShards(disabled, observer, opts, defaultNumIsolationShards())
 }
 
-func newIsolation(disabled bool) *isolation {
+// newIsolationShards is newIsolation with the shard count broken out, so
+// that benchmarks can compare different shard counts; production code
+// should always go through newIsolation.
+func newIsolationShards(disabled bool, observer IsolationObserver, opts IsolationOptions, numShards int) *isolation {
 	isoState := &isolationState{}
 	isoState.next = isoState
 	isoState.prev = isoState
 
-	appender := &isolationAppender{}
-	appender.next = appender
-	appender.prev = appender
+	shards := make([]*isolationShard, numShards)
+	for i := range shards {
+		shards[i] = newIsolationShard()
+	}
 
-	return &isolation{
-		appendsOpen:     map[uint64]*isolationAppender{},
-		appendsOpenList: appender,
+	iso := &isolation{
+		shards:          shards,
 		readsOpen:       isoState,
 		disabled:        disabled,
-		appendersPool:   sync.Pool{New: func() interface{} { return &isolationAppender{} }},
+		observer:        observer,
+		maxAppenderAge:  opts.MaxAppenderAge,
+		onForceRollback: opts.OnForceRollback,
+		reaperStop:      make(chan struct{}),
+		reaperDone:      make(chan struct{}),
+	}
+
+	if opts.MaxOpenAppenders > 0 {
+		iso.admission = make(chan struct{}, opts.MaxOpenAppenders)
 	}
+
+	if !disabled && opts.MaxAppenderAge > 0 {
+		go iso.runReaper()
+	} else {
+		close(iso.reaperDone)
+	}
+
+	return iso
+}
+
+// SetObserver installs obs as the isolation subsystem's observer. It is
+// meant for callers (db.go) that need a reference to the isolation struct
+// itself before they can build their observer, e.g. IsolationMetrics,
+// whose Collect method reads back iso.lowWatermark() and
+// iso.lowestAppendTime(). Must be called before concurrent use of iso
+// begins.
+func (i *isolation) SetObserver(obs IsolationObserver) {
+	i.observer = obs
+}
+
+// Close stops the appender-reaper goroutine, if one was started by
+// IsolationOptions.MaxAppenderAge. Safe to call even if the reaper was
+// never started, and safe to call more than once.
+func (i *isolation) Close() {
+	i.stopReaper.Do(func() {
+		close(i.reaperStop)
+	})
+	<-i.reaperDone
+}
+
+// isolationReaperInterval is how often the reaper scans for appenders that
+// have exceeded maxAppenderAge. Appenders may therefore stay open up to
+// roughly maxAppenderAge plus this interval before being force-closed.
+const isolationReaperInterval = 10 * time.Second
+
+func (i *isolation) runReaper() {
+	defer close(i.reaperDone)
+
+	ticker := time.NewTicker(isolationReaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-i.reaperStop:
+			return
+		case <-ticker.C:
+			i.reapExpiredAppenders()
+		}
+	}
+}
+
+// reapExpiredAppenders force-closes any appender that has been open for
+// longer than maxAppenderAge, so a stuck appender can't pin the low
+// watermark or grow incompleteAppends forever.
+//
+// The initial scan for expired IDs and the actual force-close must not be
+// two separate lock acquisitions: if the real appender commits or rolls
+// back normally in between, onForceRollback must not fire for it. So for
+// each shard we take appendMtx once, re-check under that same lock that an
+// expired ID is still open, and only then remove it and queue it for
+// notification (done after unlocking, so callbacks never run with the
+// shard locked).
+func (i *isolation) reapExpiredAppenders() {
+	cutoff := time.Now().Add(-i.maxAppenderAge)
+
+	type reaped struct {
+		appendID uint64
+		openedAt time.Time
+	}
+
+	for _, shard := range i.shards {
+		shard.appendMtx.Lock()
+
+		var expired []uint64
+		// appendsOpenList is oldest-first, so we can stop at the first
+		// appender that isn't expired yet.
+		for a := shard.appendsOpenList.next; a != shard.appendsOpenList; a = a.next {
+			if !a.openedAt.Before(cutoff) {
+				break
+			}
+			expired = append(expired, a.appendID)
+		}
+
+		var closed []reaped
+		for _, appendID := range expired {
+			app := shard.appendsOpen[appendID]
+			if app == nil {
+				// Defensive only: appendMtx is held across the scan above,
+				// so a listed ID is still in appendsOpen here.
+				continue
+			}
+			closed = append(closed, reaped{appendID, app.openedAt})
+
+			app.prev.next = app.next
+			app.next.prev = app.prev
+			delete(shard.appendsOpen, appendID)
+
+			// Clear all fields, and return to the pool.
+			*app = isolationAppender{}
+			shard.appendersPool.Put(app)
+		}
+
+		shard.appendMtx.Unlock()
+
+		for _, r := range closed {
+			if i.onForceRollback != nil {
+				i.onForceRollback(r.appendID)
+			}
+			if i.admission != nil {
+				<-i.admission
+			}
+			if i.observer != nil {
+				i.observer.OnAppendClosed(r.appendID, time.Since(r.openedAt).Nanoseconds())
+			}
+		}
+	}
+}
+
+// shardFor returns the shard that owns the given appendID.
+func (i *isolation) shardFor(appendID uint64) *isolationShard {
+	return i.shards[appendID%uint64(len(i.shards))]
 }
 
 // lowWatermark returns the appendID below which we no longer need to track
@@ -98,68 +357,128 @@ func (i *isolation) lowWatermark() uint64 {
 		return 0
 	}
 
-	i.appendMtx.RLock() // Take appendMtx first.
-	defer i.appendMtx.RUnlock()
 	return i.lowWatermarkLocked()
 }
 
+// lowWatermarkLocked computes the low watermark by fanning out across all
+// shards, read-locking each shard in turn (never more than one at a time),
+// and merging the results.
 func (i *isolation) lowWatermarkLocked() uint64 {
 	if i.disabled {
 		return 0
 	}
 
 	i.readMtx.RLock()
-	defer i.readMtx.RUnlock()
 	if i.readsOpen.prev != i.readsOpen {
-		return i.readsOpen.prev.lowWatermark
+		w := i.readsOpen.prev.lowWatermark
+		i.readMtx.RUnlock()
+		return w
 	}
-
-	// Lowest appendID from appenders, or lastAppendId.
-	return i.appendsOpenList.next.appendID
+	i.readMtx.RUnlock()
+
+	// No open reads: the watermark is the lowest still-open appendID across
+	// all shards, or the last appendID handed out if nothing is open.
+	low := atomic.LoadUint64(&i.lastAppendID)
+	for _, shard := range i.shards {
+		shard.appendMtx.RLock()
+		if shard.appendsOpenList.next != shard.appendsOpenList {
+			if id := shard.appendsOpenList.next.appendID; id < low {
+				low = id
+			}
+		}
+		shard.appendMtx.RUnlock()
+	}
+	return low
 }
 
 // lowestAppendTime returns the lowest minTime for any open appender,
 // or math.MaxInt64 if no open appenders.
 func (i *isolation) lowestAppendTime() int64 {
 	var lowest int64 = math.MaxInt64
-	i.appendMtx.RLock()
-	defer i.appendMtx.RUnlock()
-
-	for a := i.appendsOpenList.next; a != i.appendsOpenList; a = a.next {
-		if lowest > a.minTime {
-			lowest = a.minTime
+	for _, shard := range i.shards {
+		shard.appendMtx.RLock()
+		for a := shard.appendsOpenList.next; a != shard.appendsOpenList; a = a.next {
+			if lowest > a.minTime {
+				lowest = a.minTime
+			}
 		}
+		shard.appendMtx.RUnlock()
 	}
 	return lowest
 }
 
-// State returns an object used to control isolation
-// between a query and appends. Must be closed when complete.
-func (i *isolation) State(mint, maxt int64) *isolationState {
-	i.appendMtx.RLock() // Take append mutex before read mutex.
-	defer i.appendMtx.RUnlock()
+// snapshotAppendState RLocks every shard, in ascending index order to match
+// newAppendID/closeAppend's locking and avoid deadlock, and returns a
+// consistent point-in-time view of maxAppendID, lowWatermark and
+// incompleteAppends. If link is true, the returned isolationState is linked
+// into readsOpen before the shard locks are released, so readsOpen stays
+// ordered by lowWatermark (the oldest read at readsOpen.prev, which
+// lowWatermarkLocked relies on).
+func (i *isolation) snapshotAppendState(mint, maxt int64, link bool) *isolationState {
+	for _, shard := range i.shards {
+		shard.appendMtx.RLock()
+	}
+
+	maxAppendID := atomic.LoadUint64(&i.lastAppendID)
+	lowWatermark := maxAppendID
+	incompleteAppends := make(map[uint64]struct{})
+	for _, shard := range i.shards {
+		for k := range shard.appendsOpen {
+			incompleteAppends[k] = struct{}{}
+		}
+		if shard.appendsOpenList.next != shard.appendsOpenList {
+			if id := shard.appendsOpenList.next.appendID; id < lowWatermark {
+				lowWatermark = id
+			}
+		}
+	}
 
-	// We need to track reads even when isolation is disabled, so that head
-	// truncation can wait till reads overlapping that range have finished.
 	isoState := &isolationState{
-		maxAppendID:       i.appendsOpenList.appendID,
-		lowWatermark:      i.appendsOpenList.next.appendID, // Lowest appendID from appenders, or lastAppendId.
-		incompleteAppends: make(map[uint64]struct{}, len(i.appendsOpen)),
+		maxAppendID:       maxAppendID,
+		lowWatermark:      lowWatermark,
+		incompleteAppends: incompleteAppends,
 		isolation:         i,
 		mint:              mint,
 		maxt:              maxt,
 	}
-	for k := range i.appendsOpen {
-		isoState.incompleteAppends[k] = struct{}{}
+
+	if link {
+		i.readMtx.Lock()
+		isoState.prev = i.readsOpen
+		isoState.next = i.readsOpen.next
+		i.readsOpen.next.prev = isoState
+		i.readsOpen.next = isoState
+		i.readMtx.Unlock()
 	}
 
-	i.readMtx.Lock()
-	defer i.readMtx.Unlock()
-	isoState.prev = i.readsOpen
-	isoState.next = i.readsOpen.next
-	i.readsOpen.next.prev = isoState
-	i.readsOpen.next = isoState
+	for idx := len(i.shards) - 1; idx >= 0; idx-- {
+		i.shards[idx].appendMtx.RUnlock()
+	}
 
+	if obs := i.observer; obs != nil {
+		isoState.openedAt = time.Now()
+		obs.OnReadOpened(mint, maxt, len(incompleteAppends))
+	}
+
+	return isoState
+}
+
+// State returns an object used to control isolation
+// between a query and appends. Must be closed when complete.
+func (i *isolation) State(mint, maxt int64) *isolationState {
+	// We need to track reads even when isolation is disabled, so that head
+	// truncation can wait till reads overlapping that range have finished.
+	return i.snapshotAppendState(mint, maxt, true)
+}
+
+// SnapshotState returns an immutable, point-in-time isolation snapshot for
+// a read that must never block head truncation: unlike State, it is not
+// linked into readsOpen, so TraverseOpenReads never sees it. The trade-off:
+// the querier layer must filter out chunks truncated since the snapshot was
+// taken, and be prepared to return partial results if they're already gone.
+func (i *isolation) SnapshotState(mint, maxt int64) *isolationState {
+	isoState := i.snapshotAppendState(mint, maxt, false)
+	isoState.snapshot = true
 	return isoState
 }
 
@@ -181,39 +500,75 @@ func (i *isolation) TraverseOpenReads(f func(s *isolationState) bool) {
 // newAppendID increments the transaction counter and returns a new transaction
 // ID. The first ID returned is 1.
 // Also returns the low watermark, to keep lock/unlock operations down.
-func (i *isolation) newAppendID(minTime int64) (uint64, uint64) {
+//
+// If IsolationOptions.MaxOpenAppenders was set, newAppendID blocks until an
+// admission slot is free or ctx is done, in which case it returns ctx.Err().
+//
+// The counter is bumped via an optimistic CAS loop, holding the candidate
+// ID's shard lock across the CAS, so the counter can never advance past an
+// ID before snapshotAppendState (which locks shards before reading the
+// counter) can see that ID registered in its shard.
+func (i *isolation) newAppendID(ctx context.Context, minTime int64) (uint64, uint64, error) {
 	if i.disabled {
-		return 0, 0
+		return 0, 0, nil
 	}
 
-	i.appendMtx.Lock()
-	defer i.appendMtx.Unlock()
+	if i.admission != nil {
+		select {
+		case i.admission <- struct{}{}:
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
+		}
+	}
 
-	// Last used appendID is stored in head element.
-	i.appendsOpenList.appendID++
+	var appendID uint64
+	var shard *isolationShard
+	for {
+		last := atomic.LoadUint64(&i.lastAppendID)
+		candidate := last + 1
+		shard = i.shardFor(candidate)
+
+		lockWaitStart := time.Now()
+		shard.appendMtx.Lock()
+		if obs := i.observer; obs != nil {
+			obs.OnShardLockWait(time.Since(lockWaitStart).Nanoseconds())
+		}
+		if atomic.CompareAndSwapUint64(&i.lastAppendID, last, candidate) {
+			appendID = candidate
+			break
+		}
+		shard.appendMtx.Unlock()
+	}
+	// shard.appendMtx is held here, and i.lastAppendID == appendID: no
+	// snapshotAppendState can have read lastAppendID without also either
+	// waiting on, or already having released, this exact shard lock.
 
-	app := i.appendersPool.Get().(*isolationAppender)
-	app.appendID = i.appendsOpenList.appendID
+	app := shard.appendersPool.Get().(*isolationAppender)
+	app.appendID = appendID
 	app.minTime = minTime
-	app.prev = i.appendsOpenList.prev
-	app.next = i.appendsOpenList
+	app.openedAt = time.Now()
+	app.prev = shard.appendsOpenList.prev
+	app.next = shard.appendsOpenList
+
+	shard.appendsOpenList.prev.next = app
+	shard.appendsOpenList.prev = app
+
+	shard.appendsOpen[appendID] = app
+	shard.appendMtx.Unlock()
 
-	i.appendsOpenList.prev.next = app
-	i.appendsOpenList.prev = app
+	if obs := i.observer; obs != nil {
+		obs.OnAppendOpened(appendID, minTime)
+	}
 
-	i.appendsOpen[app.appendID] = app
-	return app.appendID, i.lowWatermarkLocked()
+	return appendID, i.lowWatermarkLocked(), nil
 }
 
-func (i *isolation) lastAppendID() uint64 {
+func (i *isolation) lastAppendIDValue() uint64 {
 	if i.disabled {
 		return 0
 	}
 
-	i.appendMtx.RLock()
-	defer i.appendMtx.RUnlock()
-
-	return i.appendsOpenList.appendID
+	return atomic.LoadUint64(&i.lastAppendID)
 }
 
 func (i *isolation) closeAppend(appendID uint64) {
@@ -221,19 +576,31 @@ func (i *isolation) closeAppend(appendID uint64) {
 		return
 	}
 
-	i.appendMtx.Lock()
-	defer i.appendMtx.Unlock()
+	shard := i.shardFor(appendID)
 
-	app := i.appendsOpen[appendID]
+	shard.appendMtx.Lock()
+	app := shard.appendsOpen[appendID]
+	var openedAt time.Time
 	if app != nil {
+		openedAt = app.openedAt
 		app.prev.next = app.next
 		app.next.prev = app.prev
 
-		delete(i.appendsOpen, appendID)
+		delete(shard.appendsOpen, appendID)
 
 		// Clear all fields, and return to the pool.
 		*app = isolationAppender{}
-		i.appendersPool.Put(app)
+		shard.appendersPool.Put(app)
+	}
+	shard.appendMtx.Unlock()
+
+	if app != nil {
+		if i.admission != nil {
+			<-i.admission
+		}
+		if i.observer != nil {
+			i.observer.OnAppendClosed(appendID, time.Since(openedAt).Nanoseconds())
+		}
 	}
 }
 
@@ -0,0 +1,145 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IsolationMetrics is the concrete IsolationObserver that db.go registers
+// alongside the rest of the head's metrics, so that MVCC-style contention
+// in the isolation subsystem (leaked appenders, long-running queries,
+// truncation stalls) is visible without pprof.
+//
+// open_appends, open_reads and the two duration histograms are
+// event-driven: they're pushed from the observer callbacks below. There's
+// no "changed" event for low_watermark or lowest_append_time, so those are
+// collected on demand, straight from iso, via the prometheus.Collector
+// methods.
+type IsolationMetrics struct {
+	iso *isolation
+
+	openAppends     prometheus.Gauge
+	openReads       prometheus.Gauge
+	appendDuration  prometheus.Histogram
+	readDuration    prometheus.Histogram
+	truncationWaits prometheus.Counter
+	shardLockWait   prometheus.Histogram
+
+	lowWatermarkDesc     *prometheus.Desc
+	lowestAppendTimeDesc *prometheus.Desc
+}
+
+// NewIsolationMetrics creates the isolation subsystem's metrics, backed by
+// iso, and registers them with r unless r is nil. The result implements
+// IsolationObserver; wire it up with iso.SetObserver(m) (iso must already
+// exist to be read back by Collect, which is why this isn't done as part
+// of newIsolation itself).
+func NewIsolationMetrics(iso *isolation, r prometheus.Registerer) *IsolationMetrics {
+	m := &IsolationMetrics{
+		iso: iso,
+		openAppends: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_tsdb_isolation_open_appends",
+			Help: "Number of appends currently open in the isolation subsystem.",
+		}),
+		openReads: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_tsdb_isolation_open_reads",
+			Help: "Number of reads currently tracked by the isolation subsystem.",
+		}),
+		appendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "prometheus_tsdb_isolation_append_duration_seconds",
+			Help:    "Time an appender stays open, from newAppendID to close.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		readDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "prometheus_tsdb_isolation_read_duration_seconds",
+			Help:    "Time a read stays open, from State/SnapshotState to close.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		truncationWaits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_isolation_truncation_waits_total",
+			Help: "How many times head truncation had to wait on TraverseOpenReads for an overlapping read to finish.",
+		}),
+		shardLockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "prometheus_tsdb_isolation_shard_lock_wait_seconds",
+			Help:    "Time newAppendID spent waiting to acquire a shard's appendMtx, a proxy for shard contention.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		lowWatermarkDesc: prometheus.NewDesc(
+			"prometheus_tsdb_isolation_low_watermark",
+			"The isolation subsystem's current low watermark appendID.",
+			nil, nil,
+		),
+		lowestAppendTimeDesc: prometheus.NewDesc(
+			"prometheus_tsdb_isolation_lowest_append_time",
+			"The minTime of the oldest currently open appender, in milliseconds.",
+			nil, nil,
+		),
+	}
+	if r != nil {
+		r.MustRegister(m.openAppends, m.openReads, m.appendDuration, m.readDuration, m.truncationWaits, m.shardLockWait, m)
+	}
+	return m
+}
+
+// Describe implements prometheus.Collector.
+func (m *IsolationMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.lowWatermarkDesc
+	ch <- m.lowestAppendTimeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (m *IsolationMetrics) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(m.lowWatermarkDesc, prometheus.GaugeValue, float64(m.iso.lowWatermark()))
+	ch <- prometheus.MustNewConstMetric(m.lowestAppendTimeDesc, prometheus.GaugeValue, float64(m.iso.lowestAppendTime()))
+}
+
+// OnAppendOpened implements IsolationObserver.
+func (m *IsolationMetrics) OnAppendOpened(appendID uint64, minTime int64) {
+	m.openAppends.Inc()
+}
+
+// OnAppendClosed implements IsolationObserver.
+func (m *IsolationMetrics) OnAppendClosed(appendID uint64, durationNs int64) {
+	m.openAppends.Dec()
+	m.appendDuration.Observe(float64(durationNs) / float64(time.Second))
+}
+
+// OnReadOpened implements IsolationObserver.
+func (m *IsolationMetrics) OnReadOpened(mint, maxt int64, incompleteAppends int) {
+	m.openReads.Inc()
+}
+
+// OnReadClosed implements IsolationObserver.
+func (m *IsolationMetrics) OnReadClosed(durationNs int64) {
+	m.openReads.Dec()
+	m.readDuration.Observe(float64(durationNs) / float64(time.Second))
+}
+
+// OnShardLockWait implements IsolationObserver.
+func (m *IsolationMetrics) OnShardLockWait(durationNs int64) {
+	m.shardLockWait.Observe(float64(durationNs) / float64(time.Second))
+}
+
+// ObserveTruncationWait should be called by head truncation right after a
+// TraverseOpenReads pass, reporting whether it found an overlapping read
+// it had to wait for. There is no head.go truncation loop in this tree to
+// call it from yet, but it's exposed here for when there is.
+func (m *IsolationMetrics) ObserveTruncationWait(waited bool) {
+	if waited {
+		m.truncationWaits.Inc()
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestIsolationShardingRoundTrip(t *testing.T) {
+	iso := newIsolation(false, nil, IsolationOptions{})
+
+	const n = 500
+	ids := make([]uint64, n)
+	for i := 0; i < n; i++ {
+		id, _, err := iso.newAppendID(context.Background(), int64(i))
+		if err != nil {
+			t.Fatalf("newAppendID: %v", err)
+		}
+		ids[i] = id
+	}
+
+	if got := iso.lastAppendIDValue(); got != n {
+		t.Fatalf("lastAppendIDValue() = %d, want %d", got, n)
+	}
+	if got := iso.lowestAppendTime(); got != 0 {
+		t.Fatalf("lowestAppendTime() = %d, want 0", got)
+	}
+
+	// Close every other append; the low watermark should track the lowest
+	// still-open ID, even though the open IDs are spread across shards.
+	for i, id := range ids {
+		if i%2 == 0 {
+			iso.closeAppend(id)
+		}
+	}
+	if got, want := iso.lowWatermark(), ids[1]; got != want {
+		t.Fatalf("lowWatermark() = %d, want %d", got, want)
+	}
+
+	for _, id := range ids {
+		iso.closeAppend(id)
+	}
+	if got := iso.lowWatermark(); got != n {
+		t.Fatalf("lowWatermark() = %d, want %d", got, n)
+	}
+	if got, want := iso.lowestAppendTime(), int64(math.MaxInt64); got != want {
+		t.Fatalf("lowestAppendTime() = %d after draining all appends, want %d", got, want)
+	}
+}
+
+// TestIsolationNewAppendIDBumpHappensUnderShardLock guards against the
+// sharding regression where lastAppendID was bumped before the owning
+// shard's appendMtx was taken: a reader fanning out across shards
+// (snapshotAppendState) could then observe the bumped counter in
+// maxAppendID while the append was still missing from that shard's
+// appendsOpen, i.e. see it as already committed while it was in fact
+// concurrent. newAppendID must not be able to advance the counter while
+// something else holds the target shard's lock.
+func TestIsolationNewAppendIDBumpHappensUnderShardLock(t *testing.T) {
+	iso := newIsolation(false, nil, IsolationOptions{})
+
+	// Pretend to be a concurrent reader/writer holding the lock for the
+	// shard that appendID 1 will land in.
+	shard := iso.shardFor(1)
+	shard.appendMtx.Lock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, _, err := iso.newAppendID(context.Background(), 0); err != nil {
+			t.Errorf("newAppendID: %v", err)
+		}
+	}()
+
+	// Give the goroutine a chance to reach (and block on) the shard lock.
+	time.Sleep(20 * time.Millisecond)
+
+	select {
+	case <-done:
+		t.Fatalf("newAppendID returned while the target shard's lock was held by someone else")
+	default:
+	}
+	if got := iso.lastAppendIDValue(); got != 0 {
+		t.Fatalf("lastAppendIDValue() = %d while the shard lock was held, want 0: counter advanced without the shard lock", got)
+	}
+
+	shard.appendMtx.Unlock()
+	<-done
+
+	if got := iso.lastAppendIDValue(); got != 1 {
+		t.Fatalf("lastAppendIDValue() = %d after newAppendID returned, want 1", got)
+	}
+}
+
+func BenchmarkIsolationAppendClose(b *testing.B) {
+	for _, shards := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			iso := newIsolationShards(false, nil, IsolationOptions{}, shards)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id, _, err := iso.newAppendID(context.Background(), 0)
+					if err != nil {
+						b.Fatal(err)
+					}
+					iso.closeAppend(id)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkIsolationStateUnderAppendLoad(b *testing.B) {
+	for _, shards := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			iso := newIsolationShards(false, nil, IsolationOptions{}, shards)
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						id, _, err := iso.newAppendID(context.Background(), 0)
+						if err != nil {
+							return
+						}
+						iso.closeAppend(id)
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					st := iso.State(0, 0)
+					st.Close()
+				}
+			})
+			b.StopTimer()
+
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// TestSnapshotStateDoesNotBlockTruncation checks that a long-lived
+// SnapshotState read is invisible to TraverseOpenReads, which is what head
+// truncation iterates over to find reads it must wait for. A regular
+// State() read must still show up there.
+func TestSnapshotStateDoesNotBlockTruncation(t *testing.T) {
+	iso := newIsolation(false, nil, IsolationOptions{})
+
+	// A long-lived snapshot read, e.g. for a big range query or a
+	// remote-read stream.
+	snap := iso.SnapshotState(0, 1000)
+	defer snap.Close()
+
+	st := iso.State(0, 1000)
+
+	sawRegularRead := false
+	iso.TraverseOpenReads(func(s *isolationState) bool {
+		if s == st {
+			sawRegularRead = true
+		}
+		if s == snap {
+			t.Fatalf("TraverseOpenReads observed the snapshot read; truncation would wait on it")
+		}
+		return true
+	})
+	if !sawRegularRead {
+		t.Fatalf("TraverseOpenReads did not see the regular State() read")
+	}
+	st.Close()
+
+	// With the only regular read closed, a simulated truncation walk
+	// must find nothing left to wait for, even with the snapshot read
+	// still open.
+	iterations := 0
+	iso.TraverseOpenReads(func(s *isolationState) bool {
+		iterations++
+		return true
+	})
+	if iterations != 0 {
+		t.Fatalf("TraverseOpenReads still has %d entries with only the snapshot read open, want 0", iterations)
+	}
+}
+
+// TestSnapshotStateStableDuringConcurrentTruncationLikeActivity checks that
+// a SnapshotState's view doesn't change once taken, even while appends are
+// concurrently opened and closed (as would happen around a concurrent head
+// truncation advancing the low watermark).
+func TestSnapshotStateStableDuringConcurrentTruncationLikeActivity(t *testing.T) {
+	iso := newIsolation(false, nil, IsolationOptions{})
+
+	id1, _, err := iso.newAppendID(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("newAppendID: %v", err)
+	}
+
+	snap := iso.SnapshotState(0, 1000)
+	wantMax := snap.maxAppendID
+	if _, ok := snap.incompleteAppends[id1]; !ok {
+		t.Fatalf("snapshot missing already-open append %d", id1)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id, _, err := iso.newAppendID(context.Background(), 0)
+				if err != nil {
+					t.Errorf("newAppendID: %v", err)
+					return
+				}
+				iso.closeAppend(id)
+			}
+		}()
+	}
+	wg.Wait()
+	iso.closeAppend(id1)
+
+	if snap.maxAppendID != wantMax {
+		t.Fatalf("snapshot maxAppendID changed from %d to %d after concurrent activity", wantMax, snap.maxAppendID)
+	}
+	if _, ok := snap.incompleteAppends[id1]; !ok {
+		t.Fatalf("snapshot lost id %d from incompleteAppends after concurrent activity", id1)
+	}
+
+	snap.Close() // Must be a safe no-op: it was never linked into readsOpen.
+}
+
+// gaugeValue looks up a single no-label gauge's current value from a
+// registry, the way a scrape would see it.
+func gaugeValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+// counterValue looks up a single no-label counter's current value.
+func counterValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func TestIsolationMetricsObserver(t *testing.T) {
+	iso := newIsolation(false, nil, IsolationOptions{})
+	reg := prometheus.NewRegistry()
+	m := NewIsolationMetrics(iso, reg)
+	iso.SetObserver(m)
+
+	id, _, err := iso.newAppendID(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("newAppendID: %v", err)
+	}
+	if got := gaugeValue(t, reg, "prometheus_tsdb_isolation_open_appends"); got != 1 {
+		t.Fatalf("open_appends = %v, want 1", got)
+	}
+	if got := gaugeValue(t, reg, "prometheus_tsdb_isolation_low_watermark"); got != float64(id) {
+		t.Fatalf("low_watermark = %v, want %d while it is the only open append", got, id)
+	}
+
+	iso.closeAppend(id)
+	if got := gaugeValue(t, reg, "prometheus_tsdb_isolation_open_appends"); got != 0 {
+		t.Fatalf("open_appends = %v, want 0", got)
+	}
+	if got := gaugeValue(t, reg, "prometheus_tsdb_isolation_low_watermark"); got != float64(id) {
+		t.Fatalf("low_watermark = %v, want %d now that the only append closed", got, id)
+	}
+
+	st := iso.State(0, 100)
+	if got := gaugeValue(t, reg, "prometheus_tsdb_isolation_open_reads"); got != 1 {
+		t.Fatalf("open_reads = %v, want 1", got)
+	}
+	st.Close()
+	if got := gaugeValue(t, reg, "prometheus_tsdb_isolation_open_reads"); got != 0 {
+		t.Fatalf("open_reads = %v, want 0", got)
+	}
+
+	m.ObserveTruncationWait(true)
+	m.ObserveTruncationWait(false)
+	m.ObserveTruncationWait(true)
+	if got := counterValue(t, reg, "prometheus_tsdb_isolation_truncation_waits_total"); got != 2 {
+		t.Fatalf("truncation_waits_total = %v, want 2", got)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, name := range []string{
+		"prometheus_tsdb_isolation_append_duration_seconds",
+		"prometheus_tsdb_isolation_read_duration_seconds",
+		"prometheus_tsdb_isolation_shard_lock_wait_seconds",
+	} {
+		found := false
+		for _, mf := range mfs {
+			if mf.GetName() == name {
+				found = true
+				if got := mf.GetMetric()[0].GetHistogram().GetSampleCount(); got != 1 {
+					t.Fatalf("%s sample count = %d, want 1", name, got)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("metric %s not registered", name)
+		}
+	}
+}
+
+// TestReapExpiredAppendersForceClosesLeakedAppender checks that an appender
+// which never calls Commit/Rollback gets force-closed by the reaper once it
+// exceeds MaxAppenderAge, and that doing so advances the low watermark and
+// fires onForceRollback exactly once for it.
+func TestReapExpiredAppendersForceClosesLeakedAppender(t *testing.T) {
+	var rolledBack []uint64
+	const maxAge = 30 * time.Millisecond
+	iso := newIsolation(false, nil, IsolationOptions{
+		MaxAppenderAge: maxAge,
+		OnForceRollback: func(appendID uint64) {
+			rolledBack = append(rolledBack, appendID)
+		},
+	})
+	defer iso.Close()
+
+	leaked, _, err := iso.newAppendID(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("newAppendID: %v", err)
+	}
+
+	if got := iso.lowWatermark(); got != leaked {
+		t.Fatalf("lowWatermark() = %d before reaping, want %d (the leaked append)", got, leaked)
+	}
+
+	time.Sleep(maxAge / 2)
+
+	// A well-behaved append opened partway through the leaked one's
+	// lifetime must not be touched by the reaper once the leaked one
+	// expires, whether or not it lands in the same shard.
+	ok, _, err := iso.newAppendID(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("newAppendID: %v", err)
+	}
+
+	time.Sleep(maxAge/2 + 5*time.Millisecond) // leaked now past maxAge, ok isn't.
+	iso.reapExpiredAppenders()
+
+	if len(rolledBack) != 1 || rolledBack[0] != leaked {
+		t.Fatalf("onForceRollback calls = %v, want exactly [%d]", rolledBack, leaked)
+	}
+	if got := iso.lowWatermark(); got != ok {
+		t.Fatalf("lowWatermark() = %d after reaping the leak, want %d (the still-open well-behaved append)", got, ok)
+	}
+
+	// Reaping again must be a no-op: the leaked appender is already gone.
+	iso.reapExpiredAppenders()
+	if len(rolledBack) != 1 {
+		t.Fatalf("onForceRollback calls = %v after a second reap pass, want still exactly 1 entry", rolledBack)
+	}
+
+	iso.closeAppend(ok)
+}
+
+// TestReapExpiredAppendersReleasesAdmissionSlot checks that force-closing a
+// leaked appender frees its admission slot, so MaxOpenAppenders doesn't wedge
+// forever just because one caller never closed its appender.
+func TestReapExpiredAppendersReleasesAdmissionSlot(t *testing.T) {
+	iso := newIsolation(false, nil, IsolationOptions{
+		MaxOpenAppenders: 1,
+		MaxAppenderAge:   time.Millisecond,
+	})
+	defer iso.Close()
+
+	if _, _, err := iso.newAppendID(context.Background(), 0); err != nil {
+		t.Fatalf("newAppendID: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	iso.reapExpiredAppenders()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := iso.newAppendID(ctx, 0); err != nil {
+		t.Fatalf("newAppendID blocked after the leaked appender's slot should have been reaped: %v", err)
+	}
+}
+
+// TestNewAppendIDAdmissionControl checks that MaxOpenAppenders bounds the
+// number of concurrently open appenders, blocking newAppendID until a slot
+// frees up or the caller's context is done.
+func TestNewAppendIDAdmissionControl(t *testing.T) {
+	iso := newIsolation(false, nil, IsolationOptions{MaxOpenAppenders: 1})
+
+	id, _, err := iso.newAppendID(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("newAppendID: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := iso.newAppendID(ctx, 0); err != context.DeadlineExceeded {
+		t.Fatalf("newAppendID with no free slot returned err = %v, want context.DeadlineExceeded", err)
+	}
+
+	iso.closeAppend(id)
+
+	id2, _, err := iso.newAppendID(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("newAppendID after the only slot freed up: %v", err)
+	}
+	iso.closeAppend(id2)
+}